@@ -3,7 +3,10 @@
 package ftp
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/textproto"
@@ -12,31 +15,155 @@ import (
 	"strings"
 )
 
+// A Dialer opens data connections for a Client.  *net.Dialer satisfies this
+// interface, and is used by default, but a Client may be pointed at an
+// alternative transport (for example, an overlay network) by setting
+// Client.DataDialer to something else.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// A Listener accepts data connections for a Client operating in active mode.
+// *net.ListenConfig satisfies this interface, and is used by default.
+type Listener interface {
+	Listen(ctx context.Context, network, address string) (net.Listener, error)
+}
+
 // A Client is an FTP client.  A single FTP connection cannot handle
 // simultaneous transfers.
 type Client struct {
 	c       net.Conn
 	proto   *textproto.Conn
 	Welcome Reply
+
+	// DataDialer opens data connections for passive mode transfers.  It
+	// defaults to &net.Dialer{}.
+	DataDialer Dialer
+
+	// DataListener opens the local listener used for active mode transfers.
+	// It defaults to &net.ListenConfig{}.
+	DataListener Listener
+
+	// ActiveMode causes data connections to be opened with PORT/EPRT
+	// instead of PASV/EPSV, for servers or clients that cannot accept
+	// inbound passive connections.
+	ActiveMode bool
+
+	// tlsConfig is set once the control channel has been secured with
+	// AuthTLS or DialTLS, and is reused to protect data connections so
+	// that TLS sessions (and thus ClientSessionCache entries) are shared.
+	tlsConfig *tls.Config
+	// protected reports whether PROT P is in effect, so data connections
+	// opened by openPassive/openActive must be wrapped in TLS.
+	protected bool
+	// implicitTLS reports whether the control connection was secured with
+	// DialTLS (implicit FTPS) as opposed to AuthTLS (explicit FTPS), so
+	// Clone knows which handshake to repeat.
+	implicitTLS bool
+
+	// network and addr are the arguments that Dial or DialTLS was called
+	// with, remembered so that Clone can redial the same server.
+	network, addr string
+	// username and password are remembered from the most recent successful
+	// Login, so that Clone can log the cloned connection in the same way.
+	username, password string
+	loggedIn           bool
 }
 
 // Dial connects to an FTP server.
-func Dial(network, addr string) (*Client, error) {
-	c, err := net.Dial(network, addr)
+func Dial(ctx context.Context, network, addr string) (*Client, error) {
+	c, err := (&net.Dialer{}).DialContext(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
-	return NewClient(c)
+	client, err := NewClient(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	client.network, client.addr = network, addr
+	return client, nil
+}
+
+// DialTLS connects to an FTP server that speaks implicit FTPS (RFC 4217),
+// conventionally on port 990, and protects both the control and data
+// connections with TLS using cfg.
+func DialTLS(ctx context.Context, network, addr string, cfg *tls.Config) (*Client, error) {
+	c, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(c, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	client, err := NewClient(ctx, tlsConn)
+	if err != nil {
+		return nil, err
+	}
+	client.network, client.addr = network, addr
+	client.tlsConfig = cfg
+	client.implicitTLS = true
+	if err := client.protectData(ctx); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// Clone opens a new control connection to the same server and, if Login has
+// already succeeded on client, logs the new connection in with the same
+// credentials.  It is used to obtain additional control connections for
+// ParallelRetrieve/ParallelStore, since a single FTP control connection
+// cannot handle simultaneous transfers.
+func (client *Client) Clone(ctx context.Context) (*Client, error) {
+	if client.network == "" {
+		return nil, errors.New("ftp: Clone requires a Client created with Dial or DialTLS")
+	}
+
+	var (
+		clone *Client
+		err   error
+	)
+	switch {
+	case client.implicitTLS:
+		clone, err = DialTLS(ctx, client.network, client.addr, client.tlsConfig)
+	default:
+		clone, err = Dial(ctx, client.network, client.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !client.implicitTLS && client.tlsConfig != nil {
+		if err := clone.AuthTLS(ctx, client.tlsConfig); err != nil {
+			clone.Close()
+			return nil, err
+		}
+	}
+	clone.DataDialer = client.DataDialer
+	clone.DataListener = client.DataListener
+	clone.ActiveMode = client.ActiveMode
+
+	if client.loggedIn {
+		if err := clone.Login(ctx, client.username, client.password); err != nil {
+			clone.Close()
+			return nil, err
+		}
+	}
+	return clone, nil
 }
 
 // NewClient creates an FTP client from an existing connection.
-func NewClient(c net.Conn) (*Client, error) {
+func NewClient(ctx context.Context, c net.Conn) (*Client, error) {
 	var err error
 	client := &Client{
-		c:     c,
-		proto: textproto.NewConn(c),
+		c:            c,
+		proto:        textproto.NewConn(c),
+		DataDialer:   &net.Dialer{},
+		DataListener: &net.ListenConfig{},
 	}
-	client.Welcome, err = client.response()
+	client.Welcome, err = client.response(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -45,8 +172,8 @@ func NewClient(c net.Conn) (*Client, error) {
 }
 
 // Quit sends the QUIT command and closes the connection.
-func (client *Client) Quit() error {
-	if _, err := client.sendCommand("QUIT"); err != nil {
+func (client *Client) Quit(ctx context.Context) error {
+	if _, err := client.sendCommand(ctx, "QUIT"); err != nil {
 		return err
 	}
 	return client.Close()
@@ -58,13 +185,13 @@ func (client *Client) Close() error {
 }
 
 // Login sends credentials to the server.
-func (client *Client) Login(username, password string) error {
-	reply, err := client.sendCommand("USER " + username)
+func (client *Client) Login(ctx context.Context, username, password string) error {
+	reply, err := client.sendCommand(ctx, "USER "+username)
 	if err != nil {
 		return err
 	}
 	if reply.Code == CodeNeedPassword {
-		reply, err = client.sendCommand("PASS " + password)
+		reply, err = client.sendCommand(ctx, "PASS "+password)
 		if err != nil {
 			return err
 		}
@@ -72,20 +199,81 @@ func (client *Client) Login(username, password string) error {
 	if !reply.PositiveComplete() {
 		return reply
 	}
+	client.username, client.password = username, password
+	client.loggedIn = true
 	return nil
 }
 
 // Do sends a command over the control connection and waits for the response.  It returns any
 // protocol error encountered while performing the command.
-func (client *Client) Do(command string) (Reply, error) {
-	return client.sendCommand(command)
+func (client *Client) Do(ctx context.Context, command string) (Reply, error) {
+	return client.sendCommand(ctx, command)
+}
+
+// AuthTLS performs explicit FTPS (RFC 4217): it sends AUTH TLS, upgrades the
+// control connection to TLS using cfg, then sends PBSZ 0 and PROT P so that
+// subsequent data connections are also protected.
+func (client *Client) AuthTLS(ctx context.Context, cfg *tls.Config) error {
+	reply, err := client.sendCommand(ctx, "AUTH TLS")
+	if err != nil {
+		return err
+	} else if !reply.PositiveComplete() {
+		return reply
+	}
+
+	tlsConn := tls.Client(client.c, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return err
+	}
+	client.c = tlsConn
+	client.proto = textproto.NewConn(tlsConn)
+	client.tlsConfig = cfg
+
+	return client.protectData(ctx)
+}
+
+// protectData sends PBSZ 0 and PROT P so that data connections opened after
+// this call are wrapped in TLS.
+func (client *Client) protectData(ctx context.Context) error {
+	if reply, err := client.sendCommand(ctx, "PBSZ 0"); err != nil {
+		return err
+	} else if !reply.PositiveComplete() {
+		return reply
+	}
+
+	reply, err := client.sendCommand(ctx, "PROT P")
+	if err != nil {
+		return err
+	} else if !reply.PositiveComplete() {
+		return reply
+	}
+	client.protected = true
+	return nil
+}
+
+// CCC sends the Clear Command Channel command (RFC 4217), reverting the
+// control connection to plaintext.  Data connections continue to be
+// protected according to the most recent PROT setting.
+func (client *Client) CCC(ctx context.Context) error {
+	reply, err := client.sendCommand(ctx, "CCC")
+	if err != nil {
+		return err
+	} else if !reply.PositiveComplete() {
+		return reply
+	}
+
+	if tlsConn, ok := client.c.(*tls.Conn); ok {
+		client.c = tlsConn.NetConn()
+		client.proto = textproto.NewConn(client.c)
+	}
+	return nil
 }
 
 // obtainPassiveAddress returns the address to dial for a new passive data
 // connection.
-func (client *Client) obtainPassiveAddress() (*net.TCPAddr, error) {
+func (client *Client) obtainPassiveAddress(ctx context.Context) (*net.TCPAddr, error) {
 	if client.c.RemoteAddr().Network() == "tcp6" {
-		reply, err := client.sendCommand("EPSV")
+		reply, err := client.sendCommand(ctx, "EPSV")
 		if err != nil {
 			return nil, err
 		} else if reply.Code != CodeExtendedPassive {
@@ -97,13 +285,17 @@ func (client *Client) obtainPassiveAddress() (*net.TCPAddr, error) {
 			return nil, err
 		}
 
+		remoteAddr, ok := client.c.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return nil, fmt.Errorf("ftp: EPSV requires a TCP control connection, got remote address of type %T", client.c.RemoteAddr())
+		}
 		return &net.TCPAddr{
-			IP:   client.c.RemoteAddr().(*net.TCPAddr).IP,
+			IP:   remoteAddr.IP,
 			Port: port,
 		}, nil
 	}
 
-	reply, err := client.sendCommand("PASV")
+	reply, err := client.sendCommand(ctx, "PASV")
 	if err != nil {
 		return nil, err
 	} else if reply.Code != CodePassive {
@@ -113,12 +305,140 @@ func (client *Client) obtainPassiveAddress() (*net.TCPAddr, error) {
 }
 
 // openPassive creates a new passive data connection.
-func (client *Client) openPassive() (*net.TCPConn, error) {
-	addr, err := client.obtainPassiveAddress()
+func (client *Client) openPassive(ctx context.Context) (net.Conn, error) {
+	addr, err := client.obtainPassiveAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.DataDialer.DialContext(ctx, "tcp", addr.String())
 	if err != nil {
 		return nil, err
 	}
-	return net.DialTCP("tcp", nil, addr)
+	return client.protectConn(ctx, conn)
+}
+
+// protectConn wraps conn in TLS, reusing client.tlsConfig (and thus its
+// ClientSessionCache, if any, for session resumption with the control
+// connection's TLS session), if PROT P is in effect.
+func (client *Client) protectConn(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	if !client.protected {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, client.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// listenActive listens locally and sends PORT or EPRT to tell the server to
+// connect back to it.  The caller must then send the transfer command
+// (preceded only by REST, if resuming), then call acceptActive to obtain the data
+// connection: the listener must not accept before the command is sent,
+// since the server does not open the data connection until it sees it.
+func (client *Client) listenActive(ctx context.Context) (net.Listener, error) {
+	// Bind the listener to the wildcard address of the same family as the
+	// control connection, so that an IPv6 control connection (which is
+	// advertised via EPRT) gets an IPv6-capable listener.  net.TCPAddr's
+	// Network method always reports "tcp" regardless of address family, so
+	// the family has to be derived from the address itself.
+	isIPv6 := false
+	if remoteAddr, ok := client.c.RemoteAddr().(*net.TCPAddr); ok {
+		isIPv6 = remoteAddr.IP.To4() == nil
+	}
+	network, wildcard := "tcp4", "0.0.0.0:0"
+	if isIPv6 {
+		network, wildcard = "tcp6", "[::]:0"
+	}
+	lc, err := client.DataListener.Listen(ctx, network, wildcard)
+	if err != nil {
+		return nil, err
+	}
+
+	listenAddr, ok := lc.Addr().(*net.TCPAddr)
+	if !ok {
+		lc.Close()
+		return nil, fmt.Errorf("ftp: active mode requires a TCP listener, got local address of type %T", lc.Addr())
+	}
+	// The listener is bound to the wildcard address, which is not
+	// connectable by the server; advertise the address the server already
+	// sees us as, i.e. the control connection's local address.
+	laddr := &net.TCPAddr{IP: listenAddr.IP, Port: listenAddr.Port}
+	if ip, err := client.localIP(); err == nil {
+		laddr.IP = ip
+	}
+
+	var reply Reply
+	if isIPv6 {
+		reply, err = client.sendCommand(ctx, "EPRT "+formatEprtArg(laddr))
+	} else {
+		reply, err = client.sendCommand(ctx, "PORT "+formatPortArg(laddr))
+	}
+	if err != nil {
+		lc.Close()
+		return nil, err
+	} else if !reply.PositiveComplete() {
+		lc.Close()
+		return nil, reply
+	}
+	return lc, nil
+}
+
+// acceptActive accepts the data connection opened by the server in response
+// to a preceding PORT/EPRT and transfer command, closing lc in the process.
+func (client *Client) acceptActive(ctx context.Context, lc net.Listener) (net.Conn, error) {
+	defer lc.Close()
+
+	type acceptResult struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan acceptResult, 1)
+	go func() {
+		conn, err := lc.Accept()
+		done <- acceptResult{conn, err}
+	}()
+	select {
+	case <-ctx.Done():
+		lc.Close()
+		<-done
+		return nil, ctx.Err()
+	case res := <-done:
+		if res.err != nil {
+			return nil, res.err
+		}
+		return client.protectConn(ctx, res.conn)
+	}
+}
+
+// localIP returns the local IP address of the control connection, which is
+// the address a PORT/EPRT command must advertise for the server to be able
+// to connect back to us.
+func (client *Client) localIP() (net.IP, error) {
+	localAddr, ok := client.c.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("ftp: active mode requires a TCP control connection, got local address of type %T", client.c.LocalAddr())
+	}
+	if localAddr.IP.IsUnspecified() {
+		return nil, errors.New("ftp: control connection has an unspecified local address")
+	}
+	return localAddr.IP, nil
+}
+
+func formatPortArg(addr *net.TCPAddr) string {
+	ip4 := addr.IP.To4()
+	return strconv.Itoa(int(ip4[0])) + "," + strconv.Itoa(int(ip4[1])) + "," +
+		strconv.Itoa(int(ip4[2])) + "," + strconv.Itoa(int(ip4[3])) + "," +
+		strconv.Itoa(addr.Port>>8) + "," + strconv.Itoa(addr.Port&0xff)
+}
+
+func formatEprtArg(addr *net.TCPAddr) string {
+	proto := "1"
+	if addr.IP.To4() == nil {
+		proto = "2"
+	}
+	return "|" + proto + "|" + addr.IP.String() + "|" + strconv.Itoa(addr.Port) + "|"
 }
 
 var pasvRegexp = regexp.MustCompile(`([0-9]+),([0-9]+),([0-9]+),([0-9]+),([0-9]+),([0-9]+)`)
@@ -162,6 +482,7 @@ func parseEpsvReply(msg string) (port int, err error) {
 type transferConn struct {
 	io.ReadWriteCloser
 	client *Client
+	ctx    context.Context
 }
 
 func (conn transferConn) Close() error {
@@ -169,7 +490,7 @@ func (conn transferConn) Close() error {
 		return err
 	}
 
-	if reply, err := conn.client.response(); err != nil {
+	if reply, err := conn.client.response(conn.ctx); err != nil {
 		return err
 	} else if !reply.PositiveComplete() {
 		return reply
@@ -177,19 +498,35 @@ func (conn transferConn) Close() error {
 	return nil
 }
 
-// transfer sends a command and opens a new passive data connection.
-func (client *Client) transfer(command, dataType string) (conn io.ReadWriteCloser, err error) {
+// transfer sends a command and opens a new data connection, in either
+// passive mode (the default) or active mode, depending on client.ActiveMode.
+// If offset is positive, it sends REST offset immediately before command,
+// so that the transfer resumes at offset instead of starting from the
+// beginning of the file: RFC 3659 §5 requires REST to immediately precede
+// the transfer command, since many servers (vsftpd, proftpd among them)
+// reset the restart marker on any intervening command such as TYPE or PASV.
+// It returns the reply to command alongside the data connection, since some
+// callers (such as StoreUnique) need information from it.
+func (client *Client) transfer(ctx context.Context, command, dataType string, offset int64) (conn io.ReadWriteCloser, reply Reply, err error) {
 	// Set type
-	if reply, err := client.sendCommand("TYPE " + dataType); err != nil {
-		return nil, err
+	if reply, err := client.sendCommand(ctx, "TYPE "+dataType); err != nil {
+		return nil, Reply{}, err
 	} else if !reply.PositiveComplete() {
-		return nil, reply
+		return nil, reply, reply
 	}
 
-	// Open data connection
-	conn, err = client.openPassive()
+	if client.ActiveMode {
+		return client.activeTransfer(ctx, command, offset)
+	}
+	return client.passiveTransfer(ctx, command, offset)
+}
+
+// passiveTransfer opens a passive data connection, then sends command,
+// preceded by REST offset if offset is positive.
+func (client *Client) passiveTransfer(ctx context.Context, command string, offset int64) (conn io.ReadWriteCloser, reply Reply, err error) {
+	conn, err = client.openPassive(ctx)
 	if err != nil {
-		return nil, err
+		return nil, Reply{}, err
 	}
 	defer func(conn io.Closer) {
 		if err != nil {
@@ -197,35 +534,143 @@ func (client *Client) transfer(command, dataType string) (conn io.ReadWriteClose
 		}
 	}(conn)
 
-	// Send command
-	if reply, err := client.sendCommand(command); err != nil {
-		return nil, err
+	if err = client.restart(ctx, offset); err != nil {
+		return nil, Reply{}, err
+	}
+
+	reply, err = client.sendCommand(ctx, command)
+	if err != nil {
+		return nil, Reply{}, err
 	} else if !reply.Positive() {
-		return nil, reply
+		return nil, reply, reply
+	}
+	return transferConn{conn, client, ctx}, reply, nil
+}
+
+// activeTransfer opens a listener and sends PORT/EPRT, then sends command,
+// preceded by REST offset if offset is positive, and only afterward accepts
+// the incoming data connection the command causes the server to open.
+func (client *Client) activeTransfer(ctx context.Context, command string, offset int64) (conn io.ReadWriteCloser, reply Reply, err error) {
+	lc, err := client.listenActive(ctx)
+	if err != nil {
+		return nil, Reply{}, err
+	}
+	closeListener := true
+	defer func() {
+		if closeListener {
+			lc.Close()
+		}
+	}()
+
+	if err = client.restart(ctx, offset); err != nil {
+		return nil, Reply{}, err
+	}
+
+	reply, err = client.sendCommand(ctx, command)
+	if err != nil {
+		return nil, Reply{}, err
+	} else if !reply.Positive() {
+		return nil, reply, reply
+	}
+
+	closeListener = false
+	dataConn, err := client.acceptActive(ctx, lc)
+	if err != nil {
+		return nil, Reply{}, err
+	}
+	return transferConn{dataConn, client, ctx}, reply, nil
+}
+
+// Text sends a command and opens a new data connection in ASCII mode.
+func (client *Client) Text(ctx context.Context, command string) (io.ReadWriteCloser, error) {
+	conn, _, err := client.transfer(ctx, command, "A", 0)
+	return conn, err
+}
+
+// Binary sends a command and opens a new data connection in image mode.
+func (client *Client) Binary(ctx context.Context, command string) (io.ReadWriteCloser, error) {
+	conn, _, err := client.transfer(ctx, command, "I", 0)
+	return conn, err
+}
+
+// RetrieveFrom opens path for reading, starting offset bytes into the file,
+// by sending REST immediately before RETR.
+func (client *Client) RetrieveFrom(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	conn, _, err := client.transfer(ctx, "RETR "+path, "I", offset)
+	return conn, err
+}
+
+// StoreFrom opens path for writing, starting offset bytes into the file, by
+// sending REST immediately before STOR.
+func (client *Client) StoreFrom(ctx context.Context, path string, offset int64) (io.WriteCloser, error) {
+	conn, _, err := client.transfer(ctx, "STOR "+path, "I", offset)
+	return conn, err
+}
+
+// restart sends REST if offset is positive, so that the command sent
+// immediately afterward resumes at offset instead of starting from the
+// beginning of the file.
+func (client *Client) restart(ctx context.Context, offset int64) error {
+	if offset <= 0 {
+		return nil
+	}
+	reply, err := client.sendCommand(ctx, "REST "+strconv.FormatInt(offset, 10))
+	if err != nil {
+		return err
+	} else if !reply.Positive() {
+		return reply
 	}
-	return transferConn{conn, client}, nil
+	return nil
 }
 
-// Text sends a command and opens a new passive data connection in ASCII mode.
-func (client *Client) Text(command string) (io.ReadWriteCloser, error) {
-	return client.transfer(command, "A")
+// StoreUnique stores data under a server-chosen unique file name, using the
+// STOU command.  The returned Reply is the server's response to STOU, which
+// conventionally names the chosen file in its Msg.
+func (client *Client) StoreUnique(ctx context.Context) (io.WriteCloser, Reply, error) {
+	conn, reply, err := client.transfer(ctx, "STOU", "I", 0)
+	return conn, reply, err
 }
 
-// Binary sends a command and opens a new passive data connection in image mode.
-func (client *Client) Binary(command string) (io.ReadWriteCloser, error) {
-	return client.transfer(command, "I")
+// Append opens path for appending, using the APPE command.
+func (client *Client) Append(ctx context.Context, path string) (io.WriteCloser, error) {
+	return client.Binary(ctx, "APPE "+path)
 }
 
-func (client *Client) sendCommand(command string) (Reply, error) {
+func (client *Client) sendCommand(ctx context.Context, command string) (Reply, error) {
 	err := client.proto.PrintfLine("%s", command)
 	if err != nil {
 		return Reply{}, err
 	}
-	return client.response()
+	return client.response(ctx)
+}
+
+// response reads a reply from the server, aborting early if ctx is done
+// before the server replies.
+func (client *Client) response(ctx context.Context) (Reply, error) {
+	if ctx == nil || ctx.Done() == nil {
+		return client.readResponse()
+	}
+	type result struct {
+		reply Reply
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		reply, err := client.readResponse()
+		done <- result{reply, err}
+	}()
+	select {
+	case <-ctx.Done():
+		client.c.Close()
+		<-done
+		return Reply{}, ctx.Err()
+	case res := <-done:
+		return res.reply, res.err
+	}
 }
 
-// response reads a reply from the server.
-func (client *Client) response() (Reply, error) {
+// readResponse reads a single reply from the server.
+func (client *Client) readResponse() (Reply, error) {
 	line, err := client.proto.ReadLine()
 	if err != nil {
 		return Reply{}, err
@@ -4,9 +4,14 @@ package ftp
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"net"
 	"net/textproto"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -47,7 +52,7 @@ func TestClientResponse(t *testing.T) {
 				W: new(bytes.Buffer),
 			}),
 		}
-		reply, err := client.response()
+		reply, err := client.readResponse()
 		if err != nil {
 			t.Errorf("tests[%d] error: %v", i, err)
 			continue
@@ -72,7 +77,7 @@ func TestClientDo(t *testing.T) {
 	client := &Client{
 		proto: textproto.NewConn(rwc),
 	}
-	reply, err := client.Do("NOOP")
+	reply, err := client.Do(context.Background(), "NOOP")
 	if err != nil {
 		t.Fatal("error:", err)
 	}
@@ -115,3 +120,141 @@ func TestEpsvReply(t *testing.T) {
 		t.Errorf("port = %v (expected %v)", port, expectedPort)
 	}
 }
+
+// TestActiveModeTransfer drives a RETR over a real loopback TCP connection
+// with ActiveMode enabled, and checks that the address advertised in the
+// PORT command is one the fake server can actually dial back to (rather
+// than the listener's wildcard bind address).
+func TestActiveModeTransfer(t *testing.T) {
+	const payload = "hello from active mode\n"
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- runActiveModeServer(ln, payload)
+	}()
+
+	ctx := context.Background()
+	client, err := Dial(ctx, "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.ActiveMode = true
+
+	rc, err := client.Binary(ctx, "RETR test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != payload {
+		t.Errorf("data = %q; want %q", data, payload)
+	}
+
+	if err := <-serverErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runActiveModeServer accepts a single control connection on ln and plays
+// the server side of a minimal active-mode RETR: TYPE, PORT, RETR.  It
+// verifies that the address given in the PORT command is routable, then
+// dials back to it to deliver payload.
+func runActiveModeServer(ln net.Listener, payload string) error {
+	conn, err := ln.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+
+	if err := tp.PrintfLine("220 ready"); err != nil {
+		return err
+	}
+
+	line, err := tp.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "TYPE ") {
+		return fmt.Errorf("expected TYPE, got %q", line)
+	}
+	if err := tp.PrintfLine("200 OK"); err != nil {
+		return err
+	}
+
+	line, err = tp.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "PORT ") {
+		return fmt.Errorf("expected PORT, got %q", line)
+	}
+	addr, err := parsePortArg(strings.TrimPrefix(line, "PORT "))
+	if err != nil {
+		return err
+	}
+	if addr.IP.IsUnspecified() {
+		return fmt.Errorf("PORT advertised unroutable address %v", addr)
+	}
+	if err := tp.PrintfLine("200 PORT OK"); err != nil {
+		return err
+	}
+
+	line, err = tp.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "RETR ") {
+		return fmt.Errorf("expected RETR, got %q", line)
+	}
+	if err := tp.PrintfLine("150 opening data connection"); err != nil {
+		return err
+	}
+
+	dataConn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		return err
+	}
+	if _, err := dataConn.Write([]byte(payload)); err != nil {
+		dataConn.Close()
+		return err
+	}
+	if err := dataConn.Close(); err != nil {
+		return err
+	}
+
+	return tp.PrintfLine("226 transfer complete")
+}
+
+// parsePortArg parses the "h1,h2,h3,h4,p1,p2" argument of a PORT command,
+// the inverse of formatPortArg.
+func parsePortArg(arg string) (*net.TCPAddr, error) {
+	parts := strings.Split(arg, ",")
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("malformed PORT argument %q", arg)
+	}
+	nums := make([]int, 6)
+	for i, s := range parts {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("malformed PORT argument %q: %v", arg, err)
+		}
+		nums[i] = n
+	}
+	return &net.TCPAddr{
+		IP:   net.IPv4(byte(nums[0]), byte(nums[1]), byte(nums[2]), byte(nums[3])),
+		Port: nums[4]<<8 | nums[5],
+	}, nil
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2011 Ross Light.
+
+package ftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An EntryType classifies the kind of filesystem object an Entry describes,
+// mirroring the "type" fact of an MLSx listing (RFC 3659).
+type EntryType string
+
+// Entry types defined by RFC 3659.  Servers may also report OS-specific
+// types such as EntryTypeUnixSymlink.
+const (
+	EntryTypeFile        EntryType = "file"
+	EntryTypeDir         EntryType = "dir"
+	EntryTypeCurrentDir  EntryType = "cdir"
+	EntryTypeParentDir   EntryType = "pdir"
+	EntryTypeUnixSymlink EntryType = "OS.unix=symlink"
+)
+
+// An Entry describes a file or directory, as returned by Stat or List.
+type Entry struct {
+	Name    string
+	Type    EntryType
+	Size    int64
+	ModTime time.Time
+	Perm    string
+
+	// Facts holds the raw fact map for the entry, keyed by lowercased fact
+	// name.  When an entry was parsed from a legacy LIST reply rather than
+	// MLST/MLSD, Facts is empty.
+	Facts map[string]string
+}
+
+// Stat retrieves facts about a single file or directory using MLST (RFC
+// 3659).
+func (client *Client) Stat(ctx context.Context, path string) (*Entry, error) {
+	reply, err := client.sendCommand(ctx, "MLST "+path)
+	if err != nil {
+		return nil, err
+	} else if !reply.PositiveComplete() {
+		return nil, reply
+	}
+	for _, line := range strings.Split(reply.Msg, "\n") {
+		line = strings.TrimPrefix(line, " ")
+		if !strings.Contains(line, "=") {
+			// Introductory or trailing line of the multi-line reply.
+			continue
+		}
+		return parseMLSxEntry(line)
+	}
+	return nil, errors.New("ftp: MLST reply contained no entry")
+}
+
+// List lists the contents of a directory using MLSD (RFC 3659), falling
+// back to parsing a LIST reply if the server does not implement MLSD.
+func (client *Client) List(ctx context.Context, path string) ([]*Entry, error) {
+	conn, err := client.Binary(ctx, "MLSD "+path)
+	if err != nil {
+		var reply Reply
+		if errors.As(err, &reply) && (reply.Code == CodeUnrecognizedCommand || reply.Code == CodeNotImplemented) {
+			return client.listLegacy(ctx, path)
+		}
+		return nil, err
+	}
+	defer conn.Close()
+
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		return nil, err
+	}
+	return parseMLSxLines(string(data)), nil
+}
+
+// listLegacy lists a directory using LIST, for servers that don't support
+// MLSD.
+func (client *Client) listLegacy(ctx context.Context, path string) ([]*Entry, error) {
+	conn, err := client.Binary(ctx, "LIST "+path)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*Entry
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" || strings.HasPrefix(line, "total ") {
+			continue
+		}
+		if entry, err := parseListLine(line); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// Size returns the size in bytes of the named file, using the SIZE command
+// (RFC 3659).
+func (client *Client) Size(ctx context.Context, path string) (int64, error) {
+	reply, err := client.sendCommand(ctx, "SIZE "+path)
+	if err != nil {
+		return 0, err
+	} else if !reply.PositiveComplete() {
+		return 0, reply
+	}
+	return strconv.ParseInt(strings.TrimSpace(reply.Msg), 10, 64)
+}
+
+// ModTime returns the last modification time of the named file, using the
+// MDTM command (RFC 3659).
+func (client *Client) ModTime(ctx context.Context, path string) (time.Time, error) {
+	reply, err := client.sendCommand(ctx, "MDTM "+path)
+	if err != nil {
+		return time.Time{}, err
+	} else if !reply.PositiveComplete() {
+		return time.Time{}, reply
+	}
+	return parseMLSxTime(strings.TrimSpace(reply.Msg))
+}
+
+// parseMLSxLines parses the body of an MLSD data connection into entries,
+// skipping any line that fails to parse.
+func parseMLSxLines(data string) []*Entry {
+	var entries []*Entry
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		if entry, err := parseMLSxEntry(line); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// parseMLSxEntry parses a single MLST/MLSD fact line of the form
+// "fact=value;fact=value; name".
+func parseMLSxEntry(line string) (*Entry, error) {
+	sp := strings.IndexByte(line, ' ')
+	if sp == -1 {
+		return nil, fmt.Errorf("ftp: malformed MLSx entry %q", line)
+	}
+	factPart, name := line[:sp], line[sp+1:]
+
+	facts := make(map[string]string)
+	for _, fact := range strings.Split(strings.TrimSuffix(factPart, ";"), ";") {
+		eq := strings.IndexByte(fact, '=')
+		if eq == -1 {
+			continue
+		}
+		facts[strings.ToLower(fact[:eq])] = fact[eq+1:]
+	}
+
+	entry := &Entry{
+		Name:  name,
+		Type:  EntryType(facts["type"]),
+		Perm:  facts["perm"],
+		Facts: facts,
+	}
+	if s, ok := facts["size"]; ok {
+		entry.Size, _ = strconv.ParseInt(s, 10, 64)
+	}
+	if m, ok := facts["modify"]; ok {
+		entry.ModTime, _ = parseMLSxTime(m)
+	}
+	return entry, nil
+}
+
+// parseMLSxTime parses the "YYYYMMDDHHMMSS[.sss]" timestamp format used by
+// the MLSx modify/create facts and the MDTM reply.
+func parseMLSxTime(s string) (time.Time, error) {
+	if i := strings.IndexByte(s, '.'); i != -1 {
+		s = s[:i]
+	}
+	return time.ParseInLocation("20060102150405", s, time.UTC)
+}
+
+var listLineRegexp = regexp.MustCompile(`^([-dlpscbD])([-rwxsStT]{9})\s+\d+\s+\S+\s+\S+\s+(\d+)\s+(\w+\s+\d+\s+[\d:]+)\s+(.+)$`)
+
+// parseListLine parses a single line of a Unix-style LIST reply.
+func parseListLine(line string) (*Entry, error) {
+	m := listLineRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return nil, fmt.Errorf("ftp: unrecognized LIST line %q", line)
+	}
+	size, err := strconv.ParseInt(m[3], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	entry := &Entry{
+		Name: m[5],
+		Size: size,
+		Perm: m[2],
+	}
+	switch m[1] {
+	case "d":
+		entry.Type = EntryTypeDir
+	case "l":
+		entry.Type = EntryTypeUnixSymlink
+	default:
+		entry.Type = EntryTypeFile
+	}
+	if t, err := time.Parse("Jan _2 15:04", m[4]); err == nil {
+		entry.ModTime = t.AddDate(time.Now().Year(), 0, 0)
+	} else if t, err := time.Parse("Jan _2 2006", m[4]); err == nil {
+		entry.ModTime = t
+	}
+	return entry, nil
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2011 Ross Light.
+
+package ftp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseMLSxEntry(t *testing.T) {
+	entry, err := parseMLSxEntry("Size=253;Modify=20201028154232;Type=file;Perm=adfr; testfile.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Name != "testfile.txt" {
+		t.Errorf("Name = %q; want %q", entry.Name, "testfile.txt")
+	}
+	if entry.Type != EntryTypeFile {
+		t.Errorf("Type = %q; want %q", entry.Type, EntryTypeFile)
+	}
+	if entry.Size != 253 {
+		t.Errorf("Size = %d; want %d", entry.Size, 253)
+	}
+	if entry.Perm != "adfr" {
+		t.Errorf("Perm = %q; want %q", entry.Perm, "adfr")
+	}
+	want := time.Date(2020, time.October, 28, 15, 42, 32, 0, time.UTC)
+	if !entry.ModTime.Equal(want) {
+		t.Errorf("ModTime = %v; want %v", entry.ModTime, want)
+	}
+}
+
+func TestParseListLine(t *testing.T) {
+	entry, err := parseListLine("drwxr-xr-x    2 user     group        4096 Jan 01 12:00 subdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Name != "subdir" {
+		t.Errorf("Name = %q; want %q", entry.Name, "subdir")
+	}
+	if entry.Type != EntryTypeDir {
+		t.Errorf("Type = %q; want %q", entry.Type, EntryTypeDir)
+	}
+	if entry.Size != 4096 {
+		t.Errorf("Size = %d; want %d", entry.Size, 4096)
+	}
+}
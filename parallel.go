@@ -0,0 +1,281 @@
+// Copyright (c) 2011 Ross Light.
+
+package ftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultBlockSize is the block size used by ParallelRetrieve/ParallelStore
+// when ParallelOptions.BlockSize is zero.
+const defaultBlockSize = 4 << 20 // 4 MiB
+
+// ParallelOptions configures a parallel transfer started by
+// (*Client).ParallelRetrieve or (*Client).ParallelStore.
+type ParallelOptions struct {
+	// Streams is the number of concurrent data connections to use for
+	// ParallelRetrieve.  Values less than 1 are treated as 1, which
+	// performs a single serial transfer.  ParallelStore ignores this field,
+	// since striping an upload across multiple connections isn't supported
+	// by real FTP servers.
+	Streams int
+
+	// BlockSize is the size of the buffer each stream of a striped
+	// ParallelRetrieve uses to move data between the data connection and
+	// the destination.  It defaults to 4 MiB.  Serial transfers (ParallelStore,
+	// and ParallelRetrieve when it performs a single RETR) do not use it.
+	BlockSize int64
+
+	// Progress, if non-nil, is called after every block transferred by any
+	// stream of a striped ParallelRetrieve, with the cumulative number of
+	// bytes moved so far and the total size of the transfer.  It is not
+	// called during serial transfers (ParallelStore, and ParallelRetrieve
+	// when it performs a single RETR).
+	Progress func(bytesDone, bytesTotal int64)
+}
+
+func (opts ParallelOptions) streams() int {
+	if opts.Streams < 1 {
+		return 1
+	}
+	return opts.Streams
+}
+
+func (opts ParallelOptions) blockSize() int64 {
+	if opts.BlockSize < 1 {
+		return defaultBlockSize
+	}
+	return opts.BlockSize
+}
+
+// byteRange is an inclusive [start, end] byte range of a file.
+type byteRange struct {
+	start, end int64
+}
+
+// splitRange divides [0, size) into n roughly equal byte ranges.
+func splitRange(size int64, n int) []byteRange {
+	if size <= 0 || n < 1 {
+		return nil
+	}
+	if int64(n) > size {
+		n = int(size)
+	}
+	chunk := size / int64(n)
+	ranges := make([]byteRange, 0, n)
+	start := int64(0)
+	for i := 0; i < n; i++ {
+		end := start + chunk - 1
+		if i == n-1 {
+			end = size - 1
+		}
+		ranges = append(ranges, byteRange{start, end})
+		start = end + 1
+	}
+	return ranges
+}
+
+// ParallelRetrieve downloads path using opts.Streams concurrent data
+// connections, each reading a distinct byte range obtained by cloning the
+// control connection with Clone, and writes the results into w at their
+// respective offsets.  It falls back to a single serial RETR if the server
+// does not support SIZE or REST, or if opts.Streams is less than 2.
+func (client *Client) ParallelRetrieve(ctx context.Context, path string, w io.WriterAt, opts ParallelOptions) (int64, error) {
+	streams := opts.streams()
+	size, err := client.Size(ctx, path)
+	if err != nil {
+		if !isUnsupported(err) {
+			return 0, err
+		}
+		streams = 1
+	}
+	if streams < 2 {
+		return client.serialRetrieve(ctx, path, w)
+	}
+
+	var bytesDone int64
+	errs := client.runRanges(ctx, splitRange(size, streams), func(rangeCtx context.Context, rg byteRange) error {
+		return client.retrieveRange(rangeCtx, path, w, rg, opts, &bytesDone, size)
+	})
+	if len(errs) > 0 {
+		if anyUnsupported(errs) {
+			return client.serialRetrieve(ctx, path, w)
+		}
+		return atomic.LoadInt64(&bytesDone), errors.Join(errs...)
+	}
+	return size, nil
+}
+
+// ParallelStore uploads the first size bytes read from r to path on the
+// server.
+//
+// Unlike ParallelRetrieve, this never stripes the upload across multiple
+// data connections: concurrently sending STOR ... REST <offset> for the
+// same path over separate control connections isn't supported by
+// essentially any real FTP server (there's no GridFTP MODE E here), so
+// doing so would silently corrupt or truncate the uploaded file rather
+// than fail loudly. This always performs a single serial STOR; opts is
+// accepted only so that ParallelStore has the same signature as
+// ParallelRetrieve, and opts.Streams is ignored.
+func (client *Client) ParallelStore(ctx context.Context, path string, r io.ReaderAt, size int64, opts ParallelOptions) (int64, error) {
+	return client.serialStore(ctx, path, r, size)
+}
+
+// runRanges runs f concurrently over ranges, one goroutine per range,
+// cancelling the remaining goroutines as soon as any of them fails.  It
+// returns the errors returned by f, if any.
+func (client *Client) runRanges(ctx context.Context, ranges []byteRange, f func(context.Context, byteRange) error) []error {
+	groupCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, rg := range ranges {
+		rg := rg
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := f(groupCtx, rg); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// retrieveRange downloads rg from path over its own cloned control
+// connection, writing each block read into w as soon as it arrives.
+func (client *Client) retrieveRange(ctx context.Context, path string, w io.WriterAt, rg byteRange, opts ParallelOptions, bytesDone *int64, total int64) (err error) {
+	stream, err := client.Clone(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	rc, err := stream.RetrieveFrom(ctx, path, rg.start)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := rc.Close()
+		if cerr == nil || err != nil {
+			return
+		}
+		// Every range but the last closes the data connection before the
+		// server reaches EOF, which the server reports as an aborted
+		// transfer rather than a completion; that reply is expected here
+		// and not a failure. Any other non-2xx reply, though, means the
+		// server hit a real error partway through and must not be
+		// silently dropped.
+		var reply Reply
+		if errors.As(cerr, &reply) && reply.Code == CodeTransferAborted {
+			return
+		}
+		err = cerr
+	}()
+
+	buf := make([]byte, opts.blockSize())
+	offset := rg.start
+	remaining := rg.end - rg.start + 1
+	for remaining > 0 {
+		want := int64(len(buf))
+		if remaining < want {
+			want = remaining
+		}
+		// want is always <= remaining, so io.ReadFull only returns a nil
+		// error once it has read exactly want bytes; any error here means
+		// the data connection closed before delivering this range in full.
+		n, rerr := io.ReadFull(rc, buf[:want])
+		if n > 0 {
+			if _, werr := w.WriteAt(buf[:n], offset); werr != nil {
+				return werr
+			}
+			offset += int64(n)
+			remaining -= int64(n)
+			reportProgress(opts, bytesDone, int64(n), total)
+		}
+		if rerr != nil {
+			return rerr
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func reportProgress(opts ParallelOptions, bytesDone *int64, n, total int64) {
+	if opts.Progress == nil {
+		return
+	}
+	opts.Progress(atomic.AddInt64(bytesDone, n), total)
+}
+
+// serialRetrieve performs a non-striped RETR, used as the ParallelRetrieve
+// fallback.
+func (client *Client) serialRetrieve(ctx context.Context, path string, w io.WriterAt) (int64, error) {
+	rc, err := client.Binary(ctx, "RETR "+path)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	return io.Copy(&writerAtWriter{w: w}, rc)
+}
+
+// serialStore performs a non-striped STOR, which is how ParallelStore always
+// uploads.
+func (client *Client) serialStore(ctx context.Context, path string, r io.ReaderAt, size int64) (int64, error) {
+	wc, err := client.Binary(ctx, "STOR "+path)
+	if err != nil {
+		return 0, err
+	}
+	defer wc.Close()
+	return io.Copy(wc, io.NewSectionReader(r, 0, size))
+}
+
+// writerAtWriter adapts an io.WriterAt to an io.Writer that writes
+// sequentially from offset zero, for use with io.Copy.
+type writerAtWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (ww *writerAtWriter) Write(p []byte) (int, error) {
+	n, err := ww.w.WriteAt(p, ww.offset)
+	ww.offset += int64(n)
+	return n, err
+}
+
+// isUnsupported reports whether err indicates that the server doesn't
+// implement the command that produced it.
+func isUnsupported(err error) bool {
+	var reply Reply
+	if !errors.As(err, &reply) {
+		return false
+	}
+	switch reply.Code {
+	case CodeUnrecognizedCommand, CodeNotImplemented, CodeParameterNotImplemented:
+		return true
+	}
+	return false
+}
+
+func anyUnsupported(errs []error) bool {
+	for _, err := range errs {
+		if isUnsupported(err) {
+			return true
+		}
+	}
+	return false
+}
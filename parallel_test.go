@@ -0,0 +1,204 @@
+// Copyright (c) 2011 Ross Light.
+
+package ftp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/textproto"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSplitRange(t *testing.T) {
+	tests := []struct {
+		size int64
+		n    int
+		want []byteRange
+	}{
+		{100, 4, []byteRange{{0, 24}, {25, 49}, {50, 74}, {75, 99}}},
+		{10, 3, []byteRange{{0, 2}, {3, 5}, {6, 9}}},
+		{2, 5, []byteRange{{0, 0}, {1, 1}}},
+		{0, 4, nil},
+	}
+	for _, tt := range tests {
+		got := splitRange(tt.size, tt.n)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitRange(%d, %d) = %v; want %v", tt.size, tt.n, got, tt.want)
+		}
+	}
+}
+
+// TestParallelRetrieve drives a 3-stream ParallelRetrieve against a fake
+// server that resets any pending REST offset when it sees an intervening
+// TYPE or PASV, the way vsftpd and proftpd do. If REST were sent before
+// TYPE/PASV (rather than immediately before RETR, as chunk0-3 requires),
+// every stream but the first would be served the file from offset 0 and
+// this test would catch the resulting corruption instead of the reload
+// happening to still pass by coincidence.
+func TestParallelRetrieve(t *testing.T) {
+	const payload = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnop"
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	serverErrs := make(chan error, 8)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if err := runParallelRetrieveConn(conn, payload); err != nil {
+					serverErrs <- err
+				}
+			}()
+		}
+	}()
+
+	ctx := context.Background()
+	client, err := Dial(ctx, "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	dst := &memWriterAt{data: make([]byte, len(payload))}
+	n, err := client.ParallelRetrieve(ctx, "test.bin", dst, ParallelOptions{Streams: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(payload)) {
+		t.Errorf("n = %d; want %d", n, len(payload))
+	}
+	if string(dst.data) != payload {
+		t.Errorf("data = %q; want %q", dst.data, payload)
+	}
+
+	select {
+	case err := <-serverErrs:
+		t.Fatal(err)
+	default:
+	}
+}
+
+// runParallelRetrieveConn plays the server side of a single control
+// connection: it answers SIZE directly, and answers exactly one
+// TYPE/PASV/[REST]/RETR sequence by serving payload starting at the most
+// recently pending REST offset, clearing that offset on any command other
+// than the RETR that consumes it.
+func runParallelRetrieveConn(conn net.Conn, payload string) error {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	if err := tp.PrintfLine("220 ready"); err != nil {
+		return err
+	}
+
+	var pendingRest int64
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return nil
+		}
+		switch {
+		case strings.HasPrefix(line, "SIZE"):
+			if err := tp.PrintfLine("213 %d", len(payload)); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "REST "):
+			n, err := strconv.ParseInt(strings.TrimPrefix(line, "REST "), 10, 64)
+			if err != nil {
+				return err
+			}
+			pendingRest = n
+			if err := tp.PrintfLine("350 Restarting at %d", n); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "TYPE"):
+			pendingRest = 0
+			if err := tp.PrintfLine("200 OK"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "PASV"):
+			pendingRest = 0
+			dataLn, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				return err
+			}
+			defer dataLn.Close()
+			addr := dataLn.Addr().(*net.TCPAddr)
+			if err := tp.PrintfLine("227 Entering Passive Mode (%s)", formatPasvReply(addr)); err != nil {
+				return err
+			}
+			done, err := serveOneRetr(tp, dataLn, payload, &pendingRest)
+			if err != nil {
+				return err
+			}
+			if done {
+				return nil
+			}
+		default:
+			return fmt.Errorf("unexpected command %q", line)
+		}
+	}
+}
+
+// serveOneRetr reads commands until it sees RETR (allowing REST to precede
+// it), serves payload from *pendingRest onward over a data connection
+// accepted from dataLn, and reports whether it did so.
+func serveOneRetr(tp *textproto.Conn, dataLn net.Listener, payload string, pendingRest *int64) (bool, error) {
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case strings.HasPrefix(line, "REST "):
+			n, err := strconv.ParseInt(strings.TrimPrefix(line, "REST "), 10, 64)
+			if err != nil {
+				return false, err
+			}
+			*pendingRest = n
+			if err := tp.PrintfLine("350 Restarting at %d", n); err != nil {
+				return false, err
+			}
+		case strings.HasPrefix(line, "RETR "):
+			offset := *pendingRest
+			*pendingRest = 0
+			if err := tp.PrintfLine("150 opening data connection"); err != nil {
+				return false, err
+			}
+			dataConn, err := dataLn.Accept()
+			if err != nil {
+				return false, err
+			}
+			if _, err := dataConn.Write([]byte(payload[offset:])); err != nil {
+				dataConn.Close()
+				return false, err
+			}
+			if err := dataConn.Close(); err != nil {
+				return false, err
+			}
+			return true, tp.PrintfLine("226 transfer complete")
+		default:
+			return false, fmt.Errorf("unexpected command %q", line)
+		}
+	}
+}
+
+// memWriterAt is an io.WriterAt backed by an in-memory byte slice, sized to
+// the whole destination up front.
+type memWriterAt struct {
+	data []byte
+}
+
+func (m *memWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return copy(m.data[off:], p), nil
+}
@@ -0,0 +1,255 @@
+// Copyright (c) 2011 Ross Light.
+
+package ftp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAuthTLSProtP drives an explicit FTPS handshake (AUTH TLS, PBSZ 0,
+// PROT P) against a fake server over a real loopback connection, then
+// checks that a subsequent RETR is actually carried over a TLS-wrapped data
+// connection: the fake server only ever speaks TLS on its data connection,
+// so the transfer can only succeed if the client wrapped its side too.
+func TestAuthTLSProtP(t *testing.T) {
+	cert := generateSelfSignedCert(t)
+	serverTLSConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	clientTLSConfig := &tls.Config{InsecureSkipVerify: true}
+
+	controlLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer controlLn.Close()
+
+	const payload = "encrypted hello\n"
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- runFTPSServer(controlLn, serverTLSConfig, payload)
+	}()
+
+	ctx := context.Background()
+	client, err := Dial(ctx, "tcp", controlLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.AuthTLS(ctx, clientTLSConfig); err != nil {
+		t.Fatal(err)
+	}
+	if !client.protected {
+		t.Error("client.protected = false after AuthTLS negotiated PROT P")
+	}
+
+	rc, err := client.Binary(ctx, "RETR test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != payload {
+		t.Errorf("data = %q; want %q", data, payload)
+	}
+
+	if err := <-serverErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runFTPSServer accepts a single control connection on ln and plays the
+// server side of an explicit-FTPS RETR: AUTH TLS, PBSZ, PROT, TYPE, PASV,
+// RETR, with both the control and data connections protected by TLS once
+// negotiated.
+func runFTPSServer(ln net.Listener, tlsConfig *tls.Config, payload string) error {
+	conn, err := ln.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+
+	if err := tp.PrintfLine("220 ready"); err != nil {
+		return err
+	}
+
+	line, err := tp.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "AUTH TLS") {
+		return fmt.Errorf("expected AUTH TLS, got %q", line)
+	}
+	if err := tp.PrintfLine("234 AUTH TLS OK"); err != nil {
+		return err
+	}
+
+	tlsConn := tls.Server(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	defer tlsConn.Close()
+	tp = textproto.NewConn(tlsConn)
+
+	line, err = tp.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "PBSZ") {
+		return fmt.Errorf("expected PBSZ, got %q", line)
+	}
+	if err := tp.PrintfLine("200 PBSZ OK"); err != nil {
+		return err
+	}
+
+	line, err = tp.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "PROT P") {
+		return fmt.Errorf("expected PROT P, got %q", line)
+	}
+	if err := tp.PrintfLine("200 PROT OK"); err != nil {
+		return err
+	}
+
+	line, err = tp.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "TYPE") {
+		return fmt.Errorf("expected TYPE, got %q", line)
+	}
+	if err := tp.PrintfLine("200 TYPE OK"); err != nil {
+		return err
+	}
+
+	dataLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer dataLn.Close()
+	dataAddr := dataLn.Addr().(*net.TCPAddr)
+
+	line, err = tp.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "PASV") {
+		return fmt.Errorf("expected PASV, got %q", line)
+	}
+	if err := tp.PrintfLine("227 Entering Passive Mode (%s)", formatPasvReply(dataAddr)); err != nil {
+		return err
+	}
+
+	// The client establishes and TLS-handshakes the data connection as soon
+	// as it dials the PASV address, before it sends RETR over the control
+	// connection, so accept it concurrently with reading the next command.
+	type dataResult struct {
+		conn *tls.Conn
+		err  error
+	}
+	dataDone := make(chan dataResult, 1)
+	go func() {
+		dataConn, err := dataLn.Accept()
+		if err != nil {
+			dataDone <- dataResult{err: err}
+			return
+		}
+		tlsDataConn := tls.Server(dataConn, tlsConfig)
+		if err := tlsDataConn.Handshake(); err != nil {
+			dataDone <- dataResult{err: err}
+			return
+		}
+		dataDone <- dataResult{conn: tlsDataConn}
+	}()
+
+	line, err = tp.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "RETR ") {
+		return fmt.Errorf("expected RETR, got %q", line)
+	}
+	if err := tp.PrintfLine("150 opening data connection"); err != nil {
+		return err
+	}
+
+	res := <-dataDone
+	if res.err != nil {
+		return res.err
+	}
+	tlsDataConn := res.conn
+	if _, err := tlsDataConn.Write([]byte(payload)); err != nil {
+		tlsDataConn.Close()
+		return err
+	}
+	if err := tlsDataConn.Close(); err != nil {
+		return err
+	}
+
+	return tp.PrintfLine("226 transfer complete")
+}
+
+// formatPasvReply formats addr as the "h1,h2,h3,h4,p1,p2" argument of a 227
+// reply, the inverse of parsePasvReply.
+func formatPasvReply(addr *net.TCPAddr) string {
+	ip4 := addr.IP.To4()
+	return fmt.Sprintf("%d,%d,%d,%d,%d,%d", ip4[0], ip4[1], ip4[2], ip4[3], addr.Port>>8, addr.Port&0xff)
+}
+
+// generateSelfSignedCert creates an ephemeral self-signed certificate for
+// 127.0.0.1, valid for the lifetime of the test.
+func generateSelfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}